@@ -0,0 +1,150 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache provides an in-process cache of room alias lookups, shared
+// by the local and federated resolution paths in clientapi/routing. It
+// exists to blunt repeated lookups of the same (often nonexistent) alias,
+// which would otherwise hit the roomserver or a remote homeserver on every
+// request.
+package cache
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "clientapi",
+			Name:      "directory_cache_hits_total",
+			Help:      "Number of room alias lookups served from the directory cache",
+		},
+	)
+	cacheNegativeHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "clientapi",
+			Name:      "directory_cache_negative_hits_total",
+			Help:      "Number of room alias lookups served from the directory cache's negative entries",
+		},
+	)
+	cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "clientapi",
+			Name:      "directory_cache_misses_total",
+			Help:      "Number of room alias lookups that were not found in the directory cache",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheNegativeHits, cacheMisses)
+}
+
+// defaultPositiveCacheTTL is how long a successful alias resolution is kept
+// before it is considered stale.
+const defaultPositiveCacheTTL = 10 * time.Minute
+
+// defaultNegativeCacheTTL is how long a "not found" result is kept. It is
+// intentionally much shorter than the positive TTL so that an alias which
+// is created shortly after being looked up becomes visible quickly.
+const defaultNegativeCacheTTL = 30 * time.Second
+
+// entry is what we actually store in the LRU; expiresAt lets us treat the
+// TTL as part of the value rather than relying on the LRU's own eviction
+// order, since golang-lru has no per-entry expiry of its own.
+type entry struct {
+	resp      gomatrixserverlib.RespDirectory
+	found     bool
+	expiresAt time.Time
+}
+
+// AliasCache caches room alias resolutions, both the local roomserver
+// lookups performed by getRoomIDForAlias and the federated
+// federation.LookupRoomAlias calls made from DirectoryRoom.
+type AliasCache struct {
+	cache       *lru.Cache
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+}
+
+// NewAliasCache creates an AliasCache that holds up to size entries.
+func NewAliasCache(size int, positiveTTL, negativeTTL time.Duration) (*AliasCache, error) {
+	if positiveTTL == 0 {
+		positiveTTL = defaultPositiveCacheTTL
+	}
+	if negativeTTL == 0 {
+		negativeTTL = defaultNegativeCacheTTL
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &AliasCache{
+		cache:       cache,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+	}, nil
+}
+
+// Get returns a cached resolution for alias. ok is false if there is no
+// usable (i.e. unexpired) cache entry, in which case the caller should
+// perform the lookup itself and call Set with the result.
+func (c *AliasCache) Get(alias string) (resp gomatrixserverlib.RespDirectory, found, ok bool) {
+	value, inCache := c.cache.Get(alias)
+	if !inCache {
+		cacheMisses.Inc()
+		return resp, false, false
+	}
+
+	e := value.(entry)
+	if time.Now().After(e.expiresAt) {
+		c.cache.Remove(alias)
+		cacheMisses.Inc()
+		return resp, false, false
+	}
+
+	if e.found {
+		cacheHits.Inc()
+	} else {
+		cacheNegativeHits.Inc()
+	}
+	return e.resp, e.found, true
+}
+
+// Set records the result of resolving alias, using the negative TTL when
+// found is false.
+func (c *AliasCache) Set(alias string, resp gomatrixserverlib.RespDirectory, found bool) {
+	ttl := c.positiveTTL
+	if !found {
+		ttl = c.negativeTTL
+	}
+	c.cache.Add(alias, entry{
+		resp:      resp,
+		found:     found,
+		expiresAt: time.Now().Add(ttl),
+	})
+}
+
+// Invalidate removes any cached resolution for alias. It is called whenever
+// SetLocalAlias or RemoveLocalAlias changes what the alias points at.
+func (c *AliasCache) Invalidate(alias string) {
+	c.cache.Remove(alias)
+}
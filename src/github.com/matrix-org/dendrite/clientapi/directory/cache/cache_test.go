@@ -0,0 +1,88 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestAliasCacheMissBeforeSet(t *testing.T) {
+	c, err := NewAliasCache(10, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewAliasCache: %v", err)
+	}
+
+	if _, _, ok := c.Get("#nothing:example.com"); ok {
+		t.Fatalf("expected cache miss for an alias that was never Set")
+	}
+}
+
+func TestAliasCachePositiveHitAndExpiry(t *testing.T) {
+	c, err := NewAliasCache(10, 30*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatalf("NewAliasCache: %v", err)
+	}
+
+	alias := "#test:example.com"
+	want := gomatrixserverlib.RespDirectory{RoomID: "!room:example.com"}
+	c.Set(alias, want, true)
+
+	got, found, ok := c.Get(alias)
+	if !ok || !found || got.RoomID != want.RoomID {
+		t.Fatalf("got %+v found=%v ok=%v, want a positive hit for %+v", got, found, ok, want)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, _, ok := c.Get(alias); ok {
+		t.Fatalf("expected positive entry to have expired after its TTL")
+	}
+}
+
+func TestAliasCacheNegativeHitAndExpiry(t *testing.T) {
+	c, err := NewAliasCache(10, time.Hour, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewAliasCache: %v", err)
+	}
+
+	alias := "#missing:example.com"
+	c.Set(alias, gomatrixserverlib.RespDirectory{}, false)
+
+	if _, found, ok := c.Get(alias); !ok || found {
+		t.Fatalf("expected a negative hit, found=%v ok=%v", found, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := c.Get(alias); ok {
+		t.Fatalf("expected negative entry to have expired after its (shorter) TTL")
+	}
+}
+
+func TestAliasCacheInvalidate(t *testing.T) {
+	c, err := NewAliasCache(10, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewAliasCache: %v", err)
+	}
+
+	alias := "#room:example.com"
+	c.Set(alias, gomatrixserverlib.RespDirectory{RoomID: "!a:example.com"}, true)
+	c.Invalidate(alias)
+
+	if _, _, ok := c.Get(alias); ok {
+		t.Fatalf("expected no cache entry for %s after Invalidate", alias)
+	}
+}
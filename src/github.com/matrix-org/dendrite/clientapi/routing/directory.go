@@ -15,11 +15,18 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/directory/cache"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
@@ -29,6 +36,11 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// defaultAliasEventsPowerLevel is the power level required to send an
+// m.room.canonical_alias event when the room's power levels don't specify
+// one explicitly, per the Client-Server API.
+const defaultAliasEventsPowerLevel = 50
+
 // DirectoryRoom looks up a room alias
 // nolint: gocyclo
 func DirectoryRoom(
@@ -38,6 +50,7 @@ func DirectoryRoom(
 	cfg *config.Dendrite,
 	rsAPI roomserverAPI.RoomserverAliasAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
+	aliasCache *cache.AliasCache,
 ) util.JSONResponse {
 	_, domain, err := gomatrixserverlib.SplitID('#', roomAlias)
 	if err != nil {
@@ -48,7 +61,7 @@ func DirectoryRoom(
 	}
 
 	if domain == cfg.Matrix.ServerName {
-		queryResp, err := getRoomIDForAlias(req, rsAPI, roomAlias)
+		queryResp, err := getRoomIDForAlias(req, rsAPI, aliasCache, roomAlias)
 		if err != nil {
 			return httputil.LogThenError(req, err)
 		}
@@ -71,8 +84,13 @@ func DirectoryRoom(
 		}
 
 		if aliasResp.AliasExists {
+			// The appservice may have just provisioned the room, so the
+			// negative entry getRoomIDForAlias cached above for this alias
+			// is now stale. Drop it before re-querying the roomserver.
+			aliasCache.Invalidate(roomAlias)
+
 			// Query the roomserver API again. We should have the room now
-			queryResp, err = getRoomIDForAlias(req, rsAPI, roomAlias)
+			queryResp, err = getRoomIDForAlias(req, rsAPI, aliasCache, roomAlias)
 			if err != nil {
 				return httputil.LogThenError(req, err)
 			}
@@ -86,17 +104,21 @@ func DirectoryRoom(
 			}
 		}
 	} else {
-		// Query the federation for this room alias
-		resp, err := federation.LookupRoomAlias(req.Context(), domain, roomAlias)
-		if err != nil {
-			switch err.(type) {
-			case gomatrix.HTTPError:
-			default:
-				// TODO: Return 502 if the remote server errored.
-				// TODO: Return 504 if the remote server timed out.
-				return httputil.LogThenError(req, err)
+		if cached, found, ok := aliasCache.Get(roomAlias); ok {
+			if found {
+				return util.JSONResponse{Code: http.StatusOK, JSON: cached}
+			}
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound(fmt.Sprintf("Room alias %s not found", roomAlias)),
 			}
 		}
+
+		resp, jsonErr := lookupRoomAliasFromServers(req, federation, domain, viaServers(req), roomAlias)
+		if jsonErr != nil {
+			return *jsonErr
+		}
+		aliasCache.Set(roomAlias, resp, len(resp.RoomID) > 0)
 		if len(resp.RoomID) > 0 {
 			return util.JSONResponse{
 				Code: http.StatusOK,
@@ -114,32 +136,159 @@ func DirectoryRoom(
 }
 
 // getRoomIDForAlias queries the roomserver API and returns a Directory Response
-// on a successful query
+// on a successful query, consulting aliasCache first to avoid hitting the
+// roomserver for aliases we've resolved recently.
 func getRoomIDForAlias(
 	req *http.Request,
 	rsAPI roomserverAPI.RoomserverAliasAPI,
+	aliasCache *cache.AliasCache,
 	roomAlias string,
 ) (resp gomatrixserverlib.RespDirectory, err error) {
+	if cached, found, ok := aliasCache.Get(roomAlias); ok {
+		if found {
+			return cached, nil
+		}
+		return gomatrixserverlib.RespDirectory{}, nil
+	}
+
 	// Query the roomserver API to check if the alias exists locally
 	queryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomAlias}
 	var queryRes roomserverAPI.GetRoomIDForAliasResponse
 	if err = rsAPI.GetRoomIDForAlias(req.Context(), &queryReq, &queryRes); err != nil {
 		return
 	}
-	return gomatrixserverlib.RespDirectory{
+	resp = gomatrixserverlib.RespDirectory{
 		RoomID:  queryRes.RoomID,
 		Servers: []gomatrixserverlib.ServerName{},
-	}, nil
+	}
+	aliasCache.Set(roomAlias, resp, len(resp.RoomID) > 0)
+	return resp, nil
+}
+
+// federationLookupTimeout bounds how long we wait on any single remote
+// server when resolving a federated room alias.
+const federationLookupTimeout = 10 * time.Second
+
+// viaServers extracts the "via" query parameters from a request, mirroring
+// the via hints accepted by /join for routing through servers that aren't
+// the alias's own domain.
+func viaServers(req *http.Request) []gomatrixserverlib.ServerName {
+	vias := req.URL.Query()["via"]
+	servers := make([]gomatrixserverlib.ServerName, len(vias))
+	for i, via := range vias {
+		servers[i] = gomatrixserverlib.ServerName(via)
+	}
+	return servers
+}
+
+// lookupRoomAliasFromServers resolves roomAlias by probing domain (the
+// alias's authoritative server) and, concurrently, any via servers supplied
+// by the caller. It waits for every probe to finish (or to be cut short by
+// federationLookupTimeout) so that it can union the Servers hints of every
+// server that answered successfully, giving the caller's subsequent /join
+// as many routing options as possible. domain is always servers[0], so on
+// a miss we fall back to its own error for status-code purposes: an
+// untrusted via server timing out or erroring out must never mask the
+// authoritative domain's definitive answer.
+func lookupRoomAliasFromServers(
+	req *http.Request,
+	federation *gomatrixserverlib.FederationClient,
+	domain gomatrixserverlib.ServerName,
+	via []gomatrixserverlib.ServerName,
+	roomAlias string,
+) (gomatrixserverlib.RespDirectory, *util.JSONResponse) {
+	servers := append([]gomatrixserverlib.ServerName{domain}, via...)
+
+	ctx, cancel := context.WithTimeout(req.Context(), federationLookupTimeout)
+	defer cancel()
+
+	type result struct {
+		resp gomatrixserverlib.RespDirectory
+		err  error
+	}
+	results := make([]result, len(servers))
+	var wg sync.WaitGroup
+	wg.Add(len(servers))
+	for i, server := range servers {
+		i, server := i, server
+		go func() {
+			defer wg.Done()
+			resp, err := federation.LookupRoomAlias(ctx, server, roomAlias)
+			results[i] = result{resp, err}
+		}()
+	}
+	wg.Wait()
+
+	var merged gomatrixserverlib.RespDirectory
+	seenServers := make(map[gomatrixserverlib.ServerName]bool)
+	addServer := func(server gomatrixserverlib.ServerName) {
+		if server != "" && !seenServers[server] {
+			seenServers[server] = true
+			merged.Servers = append(merged.Servers, server)
+		}
+	}
+	for i, r := range results {
+		if r.err != nil || len(r.resp.RoomID) == 0 {
+			continue
+		}
+		merged.RoomID = r.resp.RoomID
+		addServer(servers[i])
+		for _, server := range r.resp.Servers {
+			addServer(server)
+		}
+	}
+	if len(merged.RoomID) > 0 {
+		return merged, nil
+	}
+
+	if domainErr := results[0].err; domainErr != nil {
+		if jsonErr := mapFederationLookupError(req, domainErr); jsonErr != nil {
+			return gomatrixserverlib.RespDirectory{}, jsonErr
+		}
+	}
+
+	return gomatrixserverlib.RespDirectory{}, nil
+}
+
+// mapFederationLookupError maps a federation transport error to the
+// appropriate gateway status code. It returns nil for errors that should be
+// treated as "alias not found" rather than surfaced to the caller, matching
+// how gomatrix.HTTPError (the remote server responding, just not positively)
+// has always been handled here.
+func mapFederationLookupError(req *http.Request, err error) *util.JSONResponse {
+	switch err.(type) {
+	case gomatrix.HTTPError:
+		return nil
+	}
+
+	if err == context.DeadlineExceeded {
+		return &util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: jsonerror.Unknown("Timed out waiting for the remote server to respond"),
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: jsonerror.Unknown("Timed out waiting for the remote server to respond"),
+		}
+	}
+
+	resp := httputil.LogThenError(req, err)
+	resp.Code = http.StatusBadGateway
+	return &resp
 }
 
 // SetLocalAlias implements PUT /directory/room/{roomAlias}
-// TODO: Check if the user has the power level to set an alias
 func SetLocalAlias(
 	req *http.Request,
 	device *authtypes.Device,
 	alias string,
 	cfg *config.Dendrite,
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
+	aliasCache *cache.AliasCache,
 ) util.JSONResponse {
 	_, domain, err := gomatrixserverlib.SplitID('#', alias)
 	if err != nil {
@@ -156,6 +305,13 @@ func SetLocalAlias(
 		}
 	}
 
+	if asID, reserved := aliasReservedByAppservice(cfg, alias); reserved && device.AppserviceID != asID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This alias is reserved by an application service."),
+		}
+	}
+
 	var r struct {
 		RoomID string `json:"room_id"`
 	}
@@ -163,6 +319,10 @@ func SetLocalAlias(
 		return *resErr
 	}
 
+	if resErr := checkAliasPowerLevel(req, aliasAPI, r.RoomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+
 	queryReq := roomserverAPI.SetRoomAliasRequest{
 		UserID: device.UserID,
 		RoomID: r.RoomID,
@@ -180,6 +340,8 @@ func SetLocalAlias(
 		}
 	}
 
+	aliasCache.Invalidate(alias)
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
@@ -187,13 +349,46 @@ func SetLocalAlias(
 }
 
 // RemoveLocalAlias implements DELETE /directory/room/{roomAlias}
-// TODO: Check if the user has the power level to remove an alias
 func RemoveLocalAlias(
 	req *http.Request,
 	device *authtypes.Device,
 	alias string,
+	cfg *config.Dendrite,
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
+	aliasCache *cache.AliasCache,
 ) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('#', alias); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Room alias must be in the form '#localpart:domain'"),
+		}
+	}
+
+	var creatorRes roomserverAPI.GetCreatorIDForAliasResponse
+	creatorReq := roomserverAPI.GetCreatorIDForAliasRequest{Alias: alias}
+	if err := aliasAPI.GetCreatorIDForAlias(req.Context(), &creatorReq, &creatorRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	roomResp, err := getRoomIDForAlias(req, aliasAPI, aliasCache, alias)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	roomID := roomResp.RoomID
+
+	if creatorRes.UserID != device.UserID {
+		if resErr := checkAliasPowerLevel(req, aliasAPI, roomID, device.UserID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	if asID, reserved := aliasReservedByAppservice(cfg, alias); reserved && device.AppserviceID != asID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This alias is reserved by an application service."),
+		}
+	}
+
 	queryReq := roomserverAPI.RemoveRoomAliasRequest{
 		Alias:  alias,
 		UserID: device.UserID,
@@ -203,8 +398,89 @@ func RemoveLocalAlias(
 		return httputil.LogThenError(req, err)
 	}
 
+	aliasCache.Invalidate(alias)
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
+
+// checkAliasPowerLevel fetches the room's m.room.power_levels state and
+// returns a Forbidden response unless userID has at least the power level
+// required to send m.room.canonical_alias events. A nil return means the
+// caller is authorized to proceed. An empty roomID is not checked and
+// yields nil; a failed state query yields the error response from
+// httputil.LogThenError instead of Forbidden.
+func checkAliasPowerLevel(
+	req *http.Request,
+	aliasAPI roomserverAPI.RoomserverAliasAPI,
+	roomID, userID string,
+) *util.JSONResponse {
+	if roomID == "" {
+		return nil
+	}
+
+	var stateRes roomserverAPI.QueryStateEventResponse
+	stateReq := roomserverAPI.QueryStateEventRequest{
+		RoomID:    roomID,
+		EventType: gomatrixserverlib.MRoomPowerLevels,
+		StateKey:  "",
+	}
+	if err := aliasAPI.QueryStateEvent(req.Context(), &stateReq, &stateRes); err != nil {
+		errRes := httputil.LogThenError(req, err)
+		return &errRes
+	}
+
+	var content *gomatrixserverlib.PowerLevelContent
+	if stateRes.StateEvent != nil {
+		var c gomatrixserverlib.PowerLevelContent
+		if err := json.Unmarshal(stateRes.StateEvent.Content(), &c); err == nil {
+			content = &c
+		}
+	}
+
+	if !hasCanonicalAliasPowerLevel(content, userID) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to modify the room's canonical alias, power level too low."),
+		}
+	}
+	return nil
+}
+
+// hasCanonicalAliasPowerLevel reports whether userID has at least the power
+// level required to send m.room.canonical_alias events, given the room's
+// (already parsed) m.room.power_levels content. content may be nil, meaning
+// the room has no power_levels event, in which case the spec's defaults
+// apply: events_default/users_default of 0, and an events[] override of
+// defaultAliasEventsPowerLevel for m.room.canonical_alias specifically.
+func hasCanonicalAliasPowerLevel(content *gomatrixserverlib.PowerLevelContent, userID string) bool {
+	requiredLevel := int64(defaultAliasEventsPowerLevel)
+	userLevel := int64(0)
+	if content != nil {
+		if level, ok := content.Events["m.room.canonical_alias"]; ok {
+			requiredLevel = level
+		}
+		userLevel = content.UserLevel(userID)
+	}
+	return userLevel >= requiredLevel
+}
+
+// aliasReservedByAppservice checks whether alias falls inside an application
+// service's reserved aliases namespace, e.g. "#_irc_.*:example.com". The
+// returned asID is the ID of the owning application service. Namespace
+// regexes are defined over the full alias, not the bare localpart, so this
+// reuses the same OwnsNamespaceCoveringAlias matcher the appservice
+// component itself uses to decide whether it owns an alias.
+func aliasReservedByAppservice(cfg *config.Dendrite, alias string) (asID string, reserved bool) {
+	if cfg == nil {
+		return "", false
+	}
+	for _, as := range cfg.Derived.ApplicationServices {
+		if as.OwnsNamespaceCoveringAlias(alias) {
+			return as.ID, true
+		}
+	}
+	return "", false
+}
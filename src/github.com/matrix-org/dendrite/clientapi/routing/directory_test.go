@@ -0,0 +1,87 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestHasCanonicalAliasPowerLevelDefaultsWithNoPowerLevelsEvent(t *testing.T) {
+	if hasCanonicalAliasPowerLevel(nil, "@alice:example.com") {
+		t.Fatalf("expected a user with no explicit power level to be rejected against the default of %d", defaultAliasEventsPowerLevel)
+	}
+}
+
+func TestHasCanonicalAliasPowerLevelUserMeetsDefaultRequirement(t *testing.T) {
+	content := &gomatrixserverlib.PowerLevelContent{
+		Users: map[string]int64{"@alice:example.com": defaultAliasEventsPowerLevel},
+	}
+	if !hasCanonicalAliasPowerLevel(content, "@alice:example.com") {
+		t.Fatalf("expected a user at the default required level to be authorized")
+	}
+}
+
+func TestHasCanonicalAliasPowerLevelRespectsEventsOverride(t *testing.T) {
+	content := &gomatrixserverlib.PowerLevelContent{
+		Events: map[string]int64{"m.room.canonical_alias": 100},
+		Users:  map[string]int64{"@alice:example.com": defaultAliasEventsPowerLevel},
+	}
+	if hasCanonicalAliasPowerLevel(content, "@alice:example.com") {
+		t.Fatalf("expected a room-specific events[] override to take precedence over the spec default")
+	}
+}
+
+func TestHasCanonicalAliasPowerLevelFallsBackToUsersDefault(t *testing.T) {
+	content := &gomatrixserverlib.PowerLevelContent{
+		UsersDefault: defaultAliasEventsPowerLevel,
+	}
+	if !hasCanonicalAliasPowerLevel(content, "@bob:example.com") {
+		t.Fatalf("expected a user with no explicit entry to fall back to users_default")
+	}
+}
+
+func TestMapFederationLookupErrorTreatsRemoteHTTPErrorAsNotFound(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	err := gomatrix.HTTPError{Code: http.StatusNotFound, Message: "not found"}
+
+	if jsonErr := mapFederationLookupError(req, err); jsonErr != nil {
+		t.Fatalf("expected a remote HTTP error to fall through to the caller's own 404, got %+v", jsonErr)
+	}
+}
+
+func TestMapFederationLookupErrorMapsTimeoutTo504(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	jsonErr := mapFederationLookupError(req, context.DeadlineExceeded)
+	if jsonErr == nil || jsonErr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected a 504 for a timed-out lookup, got %+v", jsonErr)
+	}
+}
+
+func TestMapFederationLookupErrorMapsTransportErrorTo502(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	jsonErr := mapFederationLookupError(req, errors.New("connection refused"))
+	if jsonErr == nil || jsonErr.Code != http.StatusBadGateway {
+		t.Fatalf("expected a 502 for a transport error, got %+v", jsonErr)
+	}
+}
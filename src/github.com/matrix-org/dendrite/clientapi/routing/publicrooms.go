@@ -0,0 +1,318 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// defaultPublicRoomsLimit is the number of rooms returned by a /publicRooms
+// request when the caller did not ask for a specific limit.
+const defaultPublicRoomsLimit = int64(50)
+
+// publicRoomsRequest captures the parameters accepted by both the GET and
+// POST forms of /publicRooms, as defined by the Client-Server API.
+type publicRoomsRequest struct {
+	Since                string                       `json:"since,omitempty"`
+	Limit                int64                        `json:"limit,omitempty"`
+	Filter               publicRoomsFilter            `json:"filter,omitempty"`
+	IncludeAllNetworks   bool                         `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string                       `json:"third_party_instance_id,omitempty"`
+	Server               gomatrixserverlib.ServerName `json:"-"`
+}
+
+type publicRoomsFilter struct {
+	GenericSearchTerm string `json:"generic_search_term,omitempty"`
+}
+
+// publicRoomsCursor is the opaque-to-clients representation of a position in
+// the published room list. It is base64-encoded before being handed back as
+// next_batch/prev_batch so that clients treat it as an opaque token, as the
+// spec requires.
+type publicRoomsCursor struct {
+	Offset int `json:"offset"`
+}
+
+func (c publicRoomsCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePublicRoomsCursor(token string) (publicRoomsCursor, error) {
+	var c publicRoomsCursor
+	if token == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// paginatePublicRooms slices chunk into a single page according to cursor
+// and limit, returning the page plus the prev/next cursors to hand back to
+// the client. cursor.Offset is client-supplied (decoded from an opaque
+// since/next_batch token) and so is not trusted: it is clamped into
+// [0, len(chunk)] before use to avoid an out-of-range slice.
+func paginatePublicRooms(
+	chunk []gomatrixserverlib.PublicRoom,
+	cursor publicRoomsCursor,
+	limit int64,
+) (page []gomatrixserverlib.PublicRoom, prevBatch, nextBatch string) {
+	start := cursor.Offset
+	if start < 0 {
+		start = 0
+	}
+	if start > len(chunk) {
+		start = len(chunk)
+	}
+	end := start + int(limit)
+	if end < start {
+		end = start
+	}
+	if end > len(chunk) {
+		end = len(chunk)
+	}
+	page = chunk[start:end]
+
+	if start > 0 {
+		prevOffset := start - int(limit)
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		prevBatch = publicRoomsCursor{Offset: prevOffset}.encode()
+	}
+	if end < len(chunk) {
+		nextBatch = publicRoomsCursor{Offset: end}.encode()
+	}
+	return
+}
+
+// GetPostPublicRooms implements GET and POST /publicRooms
+func GetPostPublicRooms(
+	req *http.Request,
+	rsAPI roomserverAPI.RoomserverPublicRoomsAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+	federation *gomatrixserverlib.FederationClient,
+	cfg *config.Dendrite,
+) util.JSONResponse {
+	var request publicRoomsRequest
+	if req.Method == http.MethodGet {
+		limit, err := strconv.ParseInt(req.URL.Query().Get("limit"), 10, 64)
+		if err != nil {
+			limit = 0
+		}
+		request = publicRoomsRequest{
+			Since:                req.URL.Query().Get("since"),
+			Limit:                limit,
+			ThirdPartyInstanceID: req.URL.Query().Get("third_party_instance_id"),
+		}
+		request.IncludeAllNetworks = req.URL.Query().Get("include_all_networks") == "true"
+	} else {
+		if resErr := httputil.UnmarshalJSONRequest(req, &request); resErr != nil {
+			return *resErr
+		}
+	}
+	request.Server = gomatrixserverlib.ServerName(req.URL.Query().Get("server"))
+
+	if request.Limit <= 0 || request.Limit > 100 {
+		request.Limit = defaultPublicRoomsLimit
+	}
+
+	if request.Server != "" && request.Server != cfg.Matrix.ServerName {
+		return federatedPublicRooms(req, request, federation)
+	}
+
+	return localPublicRooms(req, request, rsAPI, asAPI)
+}
+
+// localPublicRooms answers a /publicRooms request out of the local
+// roomserver's list of published rooms, optionally topped up with rooms
+// contributed by application services for the requested third-party network.
+func localPublicRooms(
+	req *http.Request,
+	request publicRoomsRequest,
+	rsAPI roomserverAPI.RoomserverPublicRoomsAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	cursor, err := decodePublicRoomsCursor(request.Since)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Invalid since token"),
+		}
+	}
+
+	var queryRes roomserverAPI.QueryPublishedRoomsResponse
+	queryReq := roomserverAPI.QueryPublishedRoomsRequest{
+		NetworkID: request.ThirdPartyInstanceID,
+	}
+	if err = rsAPI.QueryPublishedRooms(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	chunk := queryRes.Chunk
+
+	// Application services can bridge rooms on other networks into the
+	// directory. Only pull these in when the caller asked for every network,
+	// or for this specific network.
+	if request.IncludeAllNetworks || request.ThirdPartyInstanceID != "" {
+		asReq := appserviceAPI.PublicRoomsRequest{
+			NetworkID: request.ThirdPartyInstanceID,
+		}
+		var asRes appserviceAPI.PublicRoomsResponse
+		if err = asAPI.QueryPublicRooms(req.Context(), &asReq, &asRes); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		chunk = append(chunk, asRes.Chunk...)
+	}
+
+	if request.Filter.GenericSearchTerm != "" {
+		chunk = filterPublicRooms(chunk, request.Filter.GenericSearchTerm)
+	}
+
+	resp := gomatrixserverlib.RespPublicRooms{
+		TotalRoomCountEstimate: len(chunk),
+	}
+	resp.Chunk, resp.PrevBatch, resp.NextBatch = paginatePublicRooms(chunk, cursor, request.Limit)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+}
+
+// federatedPublicRooms proxies a /publicRooms request to another homeserver,
+// as requested via the "server" query parameter.
+func federatedPublicRooms(
+	req *http.Request,
+	request publicRoomsRequest,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	resp, err := federation.GetPublicRooms(
+		req.Context(), request.Server, int(request.Limit), request.Since,
+		request.IncludeAllNetworks, request.ThirdPartyInstanceID,
+	)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+}
+
+// filterPublicRooms keeps only the rooms whose name, topic, canonical alias
+// or aliases contain the given search term, case-insensitively.
+func filterPublicRooms(rooms []gomatrixserverlib.PublicRoom, term string) []gomatrixserverlib.PublicRoom {
+	filtered := rooms[:0]
+	for _, room := range rooms {
+		if roomMatchesSearchTerm(room, term) {
+			filtered = append(filtered, room)
+		}
+	}
+	return filtered
+}
+
+func roomMatchesSearchTerm(room gomatrixserverlib.PublicRoom, term string) bool {
+	term = strings.ToLower(term)
+	if strings.Contains(strings.ToLower(room.Name), term) ||
+		strings.Contains(strings.ToLower(room.Topic), term) ||
+		strings.Contains(strings.ToLower(room.CanonicalAlias), term) {
+		return true
+	}
+	for _, alias := range room.Aliases {
+		if strings.Contains(strings.ToLower(alias), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoomVisibility implements GET /directory/list/room/{roomID}
+func GetRoomVisibility(
+	req *http.Request,
+	rsAPI roomserverAPI.RoomserverPublicRoomsAPI,
+	roomID string,
+) util.JSONResponse {
+	var queryRes roomserverAPI.QueryPublishedRoomsResponse
+	queryReq := roomserverAPI.QueryPublishedRoomsRequest{RoomID: roomID}
+	if err := rsAPI.QueryPublishedRooms(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	visibility := "private"
+	for _, room := range queryRes.Chunk {
+		if room.RoomID == roomID {
+			visibility = "public"
+			break
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Visibility string `json:"visibility"`
+		}{visibility},
+	}
+}
+
+// SetRoomVisibility implements PUT /directory/list/room/{roomID}
+func SetRoomVisibility(
+	req *http.Request,
+	rsAPI roomserverAPI.RoomserverPublicRoomsAPI,
+	roomID string,
+) util.JSONResponse {
+	var body struct {
+		Visibility string `json:"visibility"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.Visibility != "public" && body.Visibility != "private" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("visibility must be 'public' or 'private'"),
+		}
+	}
+
+	queryReq := roomserverAPI.SetRoomPublicityRequest{
+		RoomID:  roomID,
+		Visible: body.Visibility == "public",
+	}
+	var queryRes roomserverAPI.SetRoomPublicityResponse
+	if err := rsAPI.SetRoomPublicity(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
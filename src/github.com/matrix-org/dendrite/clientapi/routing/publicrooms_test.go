@@ -0,0 +1,89 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func testPublicRoomsChunk(n int) []gomatrixserverlib.PublicRoom {
+	chunk := make([]gomatrixserverlib.PublicRoom, n)
+	for i := range chunk {
+		chunk[i] = gomatrixserverlib.PublicRoom{RoomID: string(rune('a' + i))}
+	}
+	return chunk
+}
+
+func TestPaginatePublicRoomsNegativeOffsetDoesNotPanic(t *testing.T) {
+	chunk := testPublicRoomsChunk(5)
+
+	// A crafted since token can decode to a negative offset; it must be
+	// clamped rather than used directly as a slice bound.
+	page, _, _ := paginatePublicRooms(chunk, publicRoomsCursor{Offset: -1}, 2)
+
+	if len(page) != 2 || page[0].RoomID != chunk[0].RoomID {
+		t.Fatalf("expected the first 2 rooms, got %+v", page)
+	}
+}
+
+func TestPaginatePublicRoomsOffsetBeyondChunk(t *testing.T) {
+	chunk := testPublicRoomsChunk(3)
+
+	page, prev, next := paginatePublicRooms(chunk, publicRoomsCursor{Offset: 100}, 2)
+
+	if len(page) != 0 {
+		t.Fatalf("expected an empty page when offset is beyond the chunk, got %+v", page)
+	}
+	if next != "" {
+		t.Fatalf("expected no next_batch at the end of the list, got %q", next)
+	}
+	if prev == "" {
+		t.Fatalf("expected a prev_batch since offset was clamped down from the end")
+	}
+}
+
+func TestPaginatePublicRoomsMiddlePage(t *testing.T) {
+	chunk := testPublicRoomsChunk(10)
+
+	page, prev, next := paginatePublicRooms(chunk, publicRoomsCursor{Offset: 4}, 3)
+
+	if len(page) != 3 || page[0].RoomID != chunk[4].RoomID {
+		t.Fatalf("expected rooms[4:7], got %+v", page)
+	}
+	if prev == "" {
+		t.Fatalf("expected a prev_batch token when not on the first page")
+	}
+	if next == "" {
+		t.Fatalf("expected a next_batch token when not on the last page")
+	}
+
+	decodedPrev, err := decodePublicRoomsCursor(prev)
+	if err != nil {
+		t.Fatalf("decodePublicRoomsCursor(prev): %v", err)
+	}
+	if decodedPrev.Offset != 1 {
+		t.Fatalf("expected prev_batch to point at offset 1, got %d", decodedPrev.Offset)
+	}
+
+	decodedNext, err := decodePublicRoomsCursor(next)
+	if err != nil {
+		t.Fatalf("decodePublicRoomsCursor(next): %v", err)
+	}
+	if decodedNext.Offset != 7 {
+		t.Fatalf("expected next_batch to point at offset 7, got %d", decodedNext.Offset)
+	}
+}